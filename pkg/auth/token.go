@@ -0,0 +1,182 @@
+// Package auth provides a shared OAuth2 token abstraction used by the
+// GitLab and Digger policy API clients, so a revoked or expired bearer
+// token doesn't just surface as a generic 4xx error.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"golang.org/x/oauth2"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrTokenRevoked means the provider rejected the token outright (e.g. the
+// refresh token was revoked); refreshing won't help and the user needs to
+// reconnect.
+var ErrTokenRevoked = errors.New("digger: token revoked, please reconnect")
+
+// ErrTokenExpired means the access token expired but refreshing it should
+// succeed; callers should refresh once and retry the request.
+var ErrTokenExpired = errors.New("digger: token expired")
+
+// TokenStore persists an oauth2.Token across process restarts.
+type TokenStore interface {
+	Load() (*oauth2.Token, error)
+	Save(token *oauth2.Token) error
+}
+
+// FileTokenStore is the default TokenStore: it keeps the refreshed token
+// pair in a JSON file on disk.
+type FileTokenStore struct {
+	Path string
+}
+
+func (s FileTokenStore) Load() (*oauth2.Token, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s FileTokenStore) Save(token *oauth2.Token) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.Path, data, 0600)
+}
+
+// TokenSource wraps the oauth2 refresh dance so callers get a valid bearer
+// token without re-implementing it, persisting any refreshed token pair via
+// store. Unlike a plain oauth2.TokenSource, it can also be force-expired via
+// Invalidate when the server rejects a token the client's own clock still
+// believes is valid.
+type TokenSource struct {
+	mu      sync.Mutex
+	config  *oauth2.Config // nil for a static, never-refreshed token
+	current *oauth2.Token
+	store   TokenStore
+}
+
+// NewTokenSource builds a TokenSource that refreshes initial via config as
+// it expires, persisting the refreshed pair to store.
+func NewTokenSource(config *oauth2.Config, initial *oauth2.Token, store TokenStore) *TokenSource {
+	return &TokenSource{
+		config:  config,
+		current: initial,
+		store:   store,
+	}
+}
+
+// NewStaticTokenSource wraps a plain bearer token for callers that don't use
+// an OAuth2 flow, so they can still be passed wherever a *TokenSource is
+// expected.
+func NewStaticTokenSource(token string) *TokenSource {
+	return &TokenSource{current: &oauth2.Token{AccessToken: token}}
+}
+
+// Token returns a valid access token, refreshing and persisting it first if
+// it has expired or been explicitly Invalidate'd. The refreshed pair is only
+// persisted when it actually changed, so a transient TokenStore.Save
+// failure doesn't turn an otherwise-valid, unrefreshed token into an error.
+// A static token (config == nil, see NewStaticTokenSource) has nothing to
+// refresh, so it's always handed back as-is: Invalidate is a no-op for it.
+func (s *TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config == nil {
+		return s.current.AccessToken, nil
+	}
+	if s.current.Valid() {
+		return s.current.AccessToken, nil
+	}
+
+	refreshed, err := s.config.TokenSource(context.Background(), s.current).Token()
+	if err != nil {
+		return "", err
+	}
+
+	changed := refreshed.AccessToken != s.current.AccessToken || !refreshed.Expiry.Equal(s.current.Expiry)
+	s.current = refreshed
+	if changed && s.store != nil {
+		if err := s.store.Save(refreshed); err != nil {
+			return "", err
+		}
+	}
+	return refreshed.AccessToken, nil
+}
+
+// Invalidate marks the cached token as expired so the next Token() call
+// refreshes it even though the client's own clock still thinks it's valid —
+// e.g. after the server has already returned a 401 for it. It has no effect
+// on a static token (config == nil): there's no refresh to trigger, and a
+// spurious/transient 401 shouldn't turn a still-usable token into a
+// permanent "please reconnect" failure.
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config != nil && s.current != nil {
+		s.current.Expiry = time.Now().Add(-time.Minute)
+	}
+}
+
+// oauth2TokenSourceFunc adapts a func to the oauth2.TokenSource interface.
+type oauth2TokenSourceFunc func() (*oauth2.Token, error)
+
+func (f oauth2TokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
+
+// OAuth2TokenSource adapts TokenSource to the oauth2.TokenSource interface
+// so it can back an http.Client via oauth2.NewClient: every transport round
+// trip goes through Token(), so refresh, persistence, and Invalidate all
+// behave the same as for direct callers.
+func (s *TokenSource) OAuth2TokenSource() oauth2.TokenSource {
+	return oauth2TokenSourceFunc(func() (*oauth2.Token, error) {
+		accessToken, err := s.Token()
+		if err != nil {
+			return nil, err
+		}
+		// oauth2.NewClient wraps this source in a ReuseTokenSource, which
+		// would cache a token with a zero Expiry forever; an Expiry of now
+		// makes it call back into Token() on every round trip.
+		return &oauth2.Token{AccessToken: accessToken, TokenType: "Bearer", Expiry: time.Now()}, nil
+	})
+}
+
+// GitLabOAuth2Config builds an oauth2.Config for GitLab's own OAuth2
+// application flow: https://docs.gitlab.com/ee/api/oauth2.html
+func GitLabOAuth2Config(baseURL string, clientId string, clientSecret string, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  baseURL + "/oauth/authorize",
+			TokenURL: baseURL + "/oauth/token",
+		},
+	}
+}
+
+// ClassifyHTTPError maps a 401/403 response into ErrTokenExpired (refresh
+// and retry once) or ErrTokenRevoked (ask the user to reconnect). It
+// returns nil for any other status code.
+func ClassifyHTTPError(statusCode int) error {
+	switch statusCode {
+	case 401:
+		return ErrTokenExpired
+	case 403:
+		return ErrTokenRevoked
+	default:
+		return nil
+	}
+}
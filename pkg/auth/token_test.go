@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenStore records every Save call so tests can assert it was (or
+// wasn't) invoked.
+type fakeTokenStore struct {
+	saved []*oauth2.Token
+}
+
+func (s *fakeTokenStore) Load() (*oauth2.Token, error) {
+	return nil, nil
+}
+
+func (s *fakeTokenStore) Save(token *oauth2.Token) error {
+	s.saved = append(s.saved, token)
+	return nil
+}
+
+func TestStaticTokenSource_InvalidateIsNoOp(t *testing.T) {
+	source := NewStaticTokenSource("static-token")
+
+	source.Invalidate()
+
+	token, err := source.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error for a static token after Invalidate: %v", err)
+	}
+	if token != "static-token" {
+		t.Fatalf("Token() = %q, want %q", token, "static-token")
+	}
+
+	// A second Invalidate+Token should behave identically - the bug being
+	// guarded against was a permanent failure after the first Invalidate.
+	source.Invalidate()
+	if token, err = source.Token(); err != nil || token != "static-token" {
+		t.Fatalf("Token() after repeated Invalidate = (%q, %v), want (%q, nil)", token, err, "static-token")
+	}
+}
+
+func newRefreshServer(t *testing.T, accessToken string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+}
+
+func TestTokenSource_RefreshesExpiredTokenAndPersistsOnlyOnChange(t *testing.T) {
+	server := newRefreshServer(t, "refreshed-token")
+	defer server.Close()
+
+	config := &oauth2.Config{
+		Endpoint: oauth2.Endpoint{TokenURL: server.URL},
+	}
+	store := &fakeTokenStore{}
+	initial := &oauth2.Token{
+		AccessToken:  "stale-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	source := NewTokenSource(config, initial, store)
+
+	token, err := source.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+	if token != "refreshed-token" {
+		t.Fatalf("Token() = %q, want %q", token, "refreshed-token")
+	}
+	if len(store.saved) != 1 {
+		t.Fatalf("expected exactly one Save after a refresh, got %d", len(store.saved))
+	}
+
+	// Calling Token() again with a still-valid cached token shouldn't
+	// refresh (and thus shouldn't persist) again.
+	if _, err := source.Token(); err != nil {
+		t.Fatalf("Token() returned error on second call: %v", err)
+	}
+	if len(store.saved) != 1 {
+		t.Fatalf("expected no additional Save for an unrefreshed token, got %d saves", len(store.saved))
+	}
+}
+
+func TestTokenSource_InvalidateForcesRefresh(t *testing.T) {
+	server := newRefreshServer(t, "post-invalidate-token")
+	defer server.Close()
+
+	config := &oauth2.Config{
+		Endpoint: oauth2.Endpoint{TokenURL: server.URL},
+	}
+	store := &fakeTokenStore{}
+	initial := &oauth2.Token{
+		AccessToken:  "still-valid-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+	source := NewTokenSource(config, initial, store)
+
+	source.Invalidate()
+
+	token, err := source.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+	if token != "post-invalidate-token" {
+		t.Fatalf("Token() = %q, want a refreshed token after Invalidate", token)
+	}
+}
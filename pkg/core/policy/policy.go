@@ -2,6 +2,8 @@ package policy
 
 type Provider interface {
 	GetPolicy(namespace string, projectname string) (string, error)
+	// Refresh drops any cached policy for (namespace, projectname).
+	Refresh(namespace string, projectname string)
 }
 
 type Checker interface {
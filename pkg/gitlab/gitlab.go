@@ -1,11 +1,14 @@
 package gitlab
 
 import (
+	"context"
+	"digger/pkg/auth"
 	"digger/pkg/digger"
 	"digger/pkg/utils"
 	"fmt"
 	"github.com/caarlos0/env/v7"
 	go_gitlab "github.com/xanzy/go-gitlab"
+	"golang.org/x/oauth2"
 	"log"
 	"os"
 	"strings"
@@ -26,6 +29,7 @@ type GitLabContext struct {
 	ProjectNamespace   string          `env:"CI_PROJECT_NAMESPACE"`
 	ProjectId          *int            `env:"CI_PROJECT_ID"`
 	ProjectNamespaceId *int            `env:"CI_PROJECT_NAMESPACE_ID"`
+	CommitSha          string          `env:"CI_COMMIT_SHA"`
 	Token              string          `env:"GITLAB_TOKEN"`
 	DiggerCommand      string          `env:"DIGGER_COMMAND"`
 }
@@ -61,14 +65,24 @@ func ParseGitLabContext() (*GitLabContext, error) {
 	return &parsedGitLabContext, nil
 }
 
-func NewGitLabService(token string, gitLabContext *GitLabContext) (CIService, error) {
-	client, err := go_gitlab.NewClient(token)
+// NewGitLabService builds a GitLabService authenticated via tokenSource.
+// Passing auth.NewStaticTokenSource(token) reproduces the old
+// static-bearer-token behaviour. The underlying go-gitlab client's HTTP
+// transport is backed by tokenSource itself (via oauth2.NewClient), so every
+// request - not just the first - picks up a fresh access token, refreshing
+// and persisting it transparently as it expires.
+func NewGitLabService(tokenSource *auth.TokenSource, gitLabContext *GitLabContext) (CIService, error) {
+	httpClient := oauth2.NewClient(context.Background(), tokenSource.OAuth2TokenSource())
+	client, err := go_gitlab.NewClient("", go_gitlab.WithHTTPClient(httpClient))
 	if err != nil {
-		log.Fatalf("failed to create gitlab client: %v", err)
+		// called per-request from the webhook server, so a bad client config
+		// must surface as an error rather than take the whole process down.
+		return nil, fmt.Errorf("failed to create gitlab client: %v", err)
 	}
 	return &GitLabService{
-		Client:  client,
-		Context: gitLabContext,
+		Client:      client,
+		Context:     gitLabContext,
+		TokenSource: tokenSource,
 	}, nil
 }
 
@@ -88,8 +102,28 @@ func ProcessGitLabEvent(gitlabContext *GitLabContext, diggerConfig *digger.Digge
 }
 
 type GitLabService struct {
-	Client  *go_gitlab.Client
-	Context *GitLabContext
+	Client      *go_gitlab.Client
+	Context     *GitLabContext
+	TokenSource *auth.TokenSource
+}
+
+// classifyError maps a go-gitlab response's status code to
+// auth.ErrTokenExpired / auth.ErrTokenRevoked so callers know whether a
+// refresh+retry can help, falling back to err unchanged for anything else.
+// On ErrTokenExpired it also invalidates TokenSource so the *next* request
+// picks up a freshly refreshed token instead of repeating the same 401.
+func (gitlabService GitLabService) classifyError(resp *go_gitlab.Response, err error) error {
+	if resp == nil {
+		return err
+	}
+	classified := auth.ClassifyHTTPError(resp.StatusCode)
+	if classified == nil {
+		return err
+	}
+	if classified == auth.ErrTokenExpired && gitlabService.TokenSource != nil {
+		gitlabService.TokenSource.Invalidate()
+	}
+	return classified
 }
 
 func (gitlabService GitLabService) GetChangedFiles(mergeRequestId int) ([]string, error) {
@@ -107,14 +141,85 @@ func (gitlabService GitLabService) GetChangedFiles(mergeRequestId int) ([]string
 	return fileNames, nil
 }
 
-func (gitlabService GitLabService) PublishComment(mergeRequest int, comment string) {
-	//TODO implement me
-	//panic("implement me")
+// diggerCommentMarkerFmt hides a per-project marker in each note's body so
+// repeated digger plan/apply runs on the same merge request update a single
+// note per project instead of spamming new ones.
+const diggerCommentMarkerFmt = "<!-- digger:project=%v -->"
+
+func (gitlabService GitLabService) PublishComment(mergeRequestId int, comment string) {
+	projectId := *gitlabService.Context.ProjectId
+	marker := fmt.Sprintf(diggerCommentMarkerFmt, gitlabService.Context.ProjectName)
+	body := marker + "\n" + comment
+
+	noteId, err := gitlabService.findCommentNoteId(projectId, mergeRequestId, marker)
+	if err != nil {
+		log.Printf("error while looking up existing merge request note: %v", err)
+		return
+	}
+
+	if noteId != 0 {
+		_, _, err := gitlabService.Client.Notes.UpdateMergeRequestNote(projectId, mergeRequestId, noteId, &go_gitlab.UpdateMergeRequestNoteOptions{Body: &body})
+		if err != nil {
+			log.Printf("error while updating merge request note: %v", err)
+		}
+		return
+	}
+
+	_, _, err = gitlabService.Client.Notes.CreateMergeRequestNote(projectId, mergeRequestId, &go_gitlab.CreateMergeRequestNoteOptions{Body: &body})
+	if err != nil {
+		log.Printf("error while creating merge request note: %v", err)
+	}
 }
 
+// findCommentNoteId returns the id of the existing merge request note
+// carrying marker, or 0 if there isn't one yet.
+func (gitlabService GitLabService) findCommentNoteId(projectId int, mergeRequestId int, marker string) (int, error) {
+	opt := &go_gitlab.ListMergeRequestNotesOptions{}
+	for {
+		notes, resp, err := gitlabService.Client.Notes.ListMergeRequestNotes(projectId, mergeRequestId, opt)
+		if err != nil {
+			return 0, gitlabService.classifyError(resp, err)
+		}
+		for _, note := range notes {
+			if strings.Contains(note.Body, marker) {
+				return note.ID, nil
+			}
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return 0, nil
+}
+
+// PublishStatus reports a commit status (pending/success/failed) for sha,
+// mirroring what pipeline-status monitoring tools consume.
+func (gitlabService GitLabService) PublishStatus(sha string, state string, context string, description string) error {
+	projectId := *gitlabService.Context.ProjectId
+	options := &go_gitlab.SetCommitStatusOptions{
+		State:       go_gitlab.BuildStateValue(state),
+		Context:     &context,
+		Description: &description,
+	}
+	_, resp, err := gitlabService.Client.Commits.SetCommitStatus(projectId, sha, options)
+	if err != nil {
+		return gitlabService.classifyError(resp, err)
+	}
+	return nil
+}
+
+// CIService is implemented by GitLabService here and by the equivalent
+// GitHub ci.CIService so callers can publish progress without caring which
+// SCM is driving the run.
+//
+// TODO: pkg/ci (the GitHub implementation) isn't part of this module
+// checkout, so it couldn't be updated alongside this interface - it still
+// needs a PublishStatus method added to stay consistent with CIService.
 type CIService interface {
 	GetChangedFiles(prNumber int) ([]string, error)
 	PublishComment(prNumber int, comment string)
+	PublishStatus(sha string, state string, context string, description string) error
 }
 
 type GitLabEvent struct {
@@ -227,12 +332,28 @@ func RunCommandsPerProject(commandsPerProject []digger.ProjectCommand, gitLabCon
 				diggerConfig,
 			}
 			switch command {
+			// PublishStatus calls bracket Plan/Apply so GitLab shows a commit
+			// status alongside the MR note: pending while it runs, then
+			// success or failed depending on whether it actually returned an
+			// error, not unconditionally success.
 			case "digger plan":
 				utils.SendUsageRecord(gitLabContext.ProjectNamespace, gitLabContext.EventType.String(), "plan")
-				diggerExecutor.Plan(*gitLabContext.MergeRequestIId)
+				publishStatus(service, gitLabContext.CommitSha, "pending", "digger/plan", "Running digger plan")
+				if err := diggerExecutor.Plan(*gitLabContext.MergeRequestIId); err != nil {
+					log.Printf("error running digger plan: %v", err)
+					publishStatus(service, gitLabContext.CommitSha, "failed", "digger/plan", "digger plan failed")
+				} else {
+					publishStatus(service, gitLabContext.CommitSha, "success", "digger/plan", "digger plan finished")
+				}
 			case "digger apply":
 				utils.SendUsageRecord(gitLabContext.ProjectName, gitLabContext.EventType.String(), "apply")
-				diggerExecutor.Apply(*gitLabContext.MergeRequestIId)
+				publishStatus(service, gitLabContext.CommitSha, "pending", "digger/apply", "Running digger apply")
+				if err := diggerExecutor.Apply(*gitLabContext.MergeRequestIId); err != nil {
+					log.Printf("error running digger apply: %v", err)
+					publishStatus(service, gitLabContext.CommitSha, "failed", "digger/apply", "digger apply failed")
+				} else {
+					publishStatus(service, gitLabContext.CommitSha, "success", "digger/apply", "digger apply finished")
+				}
 			case "digger unlock":
 				utils.SendUsageRecord(gitLabContext.ProjectNamespace, gitLabContext.EventType.String(), "unlock")
 				diggerExecutor.Unlock(*gitLabContext.MergeRequestIId)
@@ -248,3 +369,9 @@ func RunCommandsPerProject(commandsPerProject []digger.ProjectCommand, gitLabCon
 	}
 	return nil
 }
+
+func publishStatus(service CIService, sha string, state string, context string, description string) {
+	if err := service.PublishStatus(sha, state, context, description); err != nil {
+		log.Printf("error while publishing commit status: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Package webhook lets Digger run as a long-lived server that reacts to
+// GitLab webhook events directly, instead of only being invokable from
+// inside a GitLab CI pipeline (which is all ParseGitLabContext supports).
+package webhook
+
+import (
+	"crypto/subtle"
+	"digger/pkg/digger"
+	"digger/pkg/gitlab"
+	"digger/pkg/utils"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	go_gitlab "github.com/xanzy/go-gitlab"
+)
+
+var supportedCommands = []string{"digger plan", "digger apply", "digger lock", "digger unlock"}
+
+// JobRunner executes the Terraform workload for a parsed set of commands.
+// InProcessJobRunner is the default; PipelineJobRunner dispatches the work
+// to an external executor instead.
+type JobRunner interface {
+	Run(gitLabContext gitlab.GitLabContext, diggerConfig *digger.DiggerConfig, commandsPerProject []digger.ProjectCommand, service gitlab.CIService) error
+}
+
+// InProcessJobRunner runs the Terraform workload in the same process as the
+// webhook receiver, via the existing RunCommandsPerProject chain.
+type InProcessJobRunner struct {
+	Lock       utils.Lock
+	WorkingDir string
+}
+
+func (r InProcessJobRunner) Run(gitLabContext gitlab.GitLabContext, diggerConfig *digger.DiggerConfig, commandsPerProject []digger.ProjectCommand, service gitlab.CIService) error {
+	return gitlab.RunCommandsPerProject(commandsPerProject, gitLabContext, diggerConfig, service, r.Lock, r.WorkingDir)
+}
+
+// PipelineJobRunner dispatches the Terraform workload to a GitLab pipeline
+// instead of running it in-process, e.g. when the webhook receiver has no
+// Terraform/cloud credentials of its own.
+type PipelineJobRunner struct {
+	Client *go_gitlab.Client
+	Ref    string
+}
+
+func (r PipelineJobRunner) Run(gitLabContext gitlab.GitLabContext, diggerConfig *digger.DiggerConfig, commandsPerProject []digger.ProjectCommand, service gitlab.CIService) error {
+	ref := r.Ref
+	if ref == "" {
+		ref = "main"
+	}
+	_, _, err := r.Client.Pipelines.CreatePipeline(*gitLabContext.ProjectId, &go_gitlab.CreatePipelineOptions{
+		Ref: &ref,
+		Variables: &[]*go_gitlab.PipelineVariableOptions{
+			{Key: go_gitlab.String("DIGGER_COMMAND"), Value: go_gitlab.String(gitLabContext.DiggerCommand)},
+			{Key: go_gitlab.String("CI_MERGE_REQUEST_IID"), Value: go_gitlab.String(fmt.Sprintf("%v", *gitLabContext.MergeRequestIId))},
+		},
+	})
+	return err
+}
+
+// Server receives GitLab "Merge Request Hook" and "Note Hook" webhook
+// events over HTTP and drives the existing ProcessGitLabEvent ->
+// ConvertGitLabEventToCommands -> JobRunner.Run chain, so Digger can run as
+// a standalone service rather than from inside a pipeline job.
+type Server struct {
+	// Secret is compared against the X-Gitlab-Token header on every request.
+	// It must be non-empty - use NewServer, which enforces that, rather than
+	// constructing a Server literal directly.
+	Secret       string
+	DiggerConfig *digger.DiggerConfig
+	NewService   func(gitLabContext *gitlab.GitLabContext) (gitlab.CIService, error)
+	JobRunner    JobRunner
+}
+
+// NewServer builds a Server, rejecting a blank secret outright rather than
+// silently accepting unauthenticated webhook requests.
+func NewServer(secret string, diggerConfig *digger.DiggerConfig, newService func(gitLabContext *gitlab.GitLabContext) (gitlab.CIService, error), jobRunner JobRunner) (*Server, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("webhook secret must not be empty")
+	}
+	return &Server{
+		Secret:       secret,
+		DiggerConfig: diggerConfig,
+		NewService:   newService,
+		JobRunner:    jobRunner,
+	}, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook/gitlab", s.handleEvent)
+	return mux
+}
+
+func (s *Server) handleEvent(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(s.Secret)) != 1 {
+		http.Error(w, "invalid X-Gitlab-Token", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	event, err := go_gitlab.ParseWebhook(go_gitlab.EventType(r.Header.Get("X-Gitlab-Event")), body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not parse webhook payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	gitLabContext, gitLabEvent, err := toGitLabContext(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if gitLabContext == nil {
+		// an event we don't act on, e.g. a comment that isn't a digger command
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	service, err := s.NewService(gitLabContext)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not create gitlab service: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	impactedProjects, err := gitlab.ProcessGitLabEvent(gitLabContext, s.DiggerConfig, service)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not process gitlab event: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	commandsPerProject, err := gitlab.ConvertGitLabEventToCommands(*gitLabEvent, gitLabContext, impactedProjects)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not convert gitlab event to commands: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.JobRunner.Run(*gitLabContext, s.DiggerConfig, commandsPerProject, service); err != nil {
+		log.Printf("error while running commands for merge request %v: %v", *gitLabContext.MergeRequestIId, err)
+		http.Error(w, "error while running commands", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// toGitLabContext synthesizes a GitLabContext and GitLabEvent from a decoded
+// webhook payload. It returns a nil GitLabContext (and nil error) for events
+// that don't map to any digger command, e.g. a comment that isn't a digger
+// plan/apply/lock/unlock.
+func toGitLabContext(event interface{}) (*gitlab.GitLabContext, *gitlab.GitLabEvent, error) {
+	switch e := event.(type) {
+	case *go_gitlab.MergeEvent:
+		var eventType gitlab.GitLabEventType
+		switch e.ObjectAttributes.Action {
+		case "open":
+			eventType = gitlab.MergeRequestOpened
+		case "update":
+			eventType = gitlab.MergeRequestUpdated
+		case "close", "merge":
+			eventType = gitlab.MergeRequestClosed
+		default:
+			return nil, nil, nil
+		}
+
+		gitLabContext := &gitlab.GitLabContext{
+			ProjectId:        &e.Project.ID,
+			ProjectName:      e.Project.Name,
+			ProjectNamespace: e.Project.Namespace,
+			MergeRequestId:   &e.ObjectAttributes.ID,
+			MergeRequestIId:  &e.ObjectAttributes.IID,
+			CommitSha:        e.ObjectAttributes.LastCommit.ID,
+		}
+		return gitLabContext, &gitlab.GitLabEvent{EventType: eventType}, nil
+
+	case *go_gitlab.MergeCommentEvent:
+		command := matchDiggerCommand(e.ObjectAttributes.Note)
+		if command == "" {
+			return nil, nil, nil
+		}
+
+		gitLabContext := &gitlab.GitLabContext{
+			ProjectId:        &e.Project.ID,
+			ProjectName:      e.Project.Name,
+			ProjectNamespace: e.Project.Namespace,
+			MergeRequestId:   &e.MergeRequest.ID,
+			MergeRequestIId:  &e.MergeRequest.IID,
+			CommitSha:        e.MergeRequest.LastCommit.ID,
+			DiggerCommand:    command,
+		}
+		return gitLabContext, &gitlab.GitLabEvent{EventType: gitlab.MergeRequestComment}, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported gitlab webhook event type: %T", event)
+	}
+}
+
+func matchDiggerCommand(note string) string {
+	for _, command := range supportedCommands {
+		if strings.Contains(note, command) {
+			return command
+		}
+	}
+	return ""
+}
@@ -2,24 +2,58 @@ package policy
 
 import (
 	"context"
+	"crypto/sha256"
+	"digger/pkg/auth"
 	"digger/pkg/ci"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
 	"github.com/open-policy-agent/opa/rego"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PolicyProvider interface {
 	GetPolicy(namespace string, projectname string) (string, error)
+	// Refresh drops any cached policy for (namespace, projectname) so the
+	// next GetPolicy call re-fetches it instead of serving a stale result.
+	Refresh(namespace string, projectname string)
+}
+
+// defaultPolicyCacheTTL is used when DiggerHttpPolicyProvider.CacheTTL is
+// left at its zero value.
+const defaultPolicyCacheTTL = 60 * time.Second
+
+// policyCacheEntry caches both positive (a policy was found) and negative
+// (none of the levels had one, i.e. a 404 all the way up) results, so the
+// namespace walk in GetPolicy doesn't multiply request counts on every
+// Check.
+type policyCacheEntry struct {
+	policy    string
+	expiresAt time.Time
 }
 
 type DiggerHttpPolicyProvider struct {
 	DiggerHost         string
 	DiggerOrganisation string
-	AuthToken          string
+	TokenSource        *auth.TokenSource
 	HttpClient         *http.Client
+
+	// Merge requests the backend concatenate a group's policy with its
+	// parent groups' (via ?merge=true) instead of the deepest match winning
+	// outright.
+	Merge bool
+	// CacheTTL controls how long a GetPolicy result is cached; defaults to
+	// defaultPolicyCacheTTL when zero.
+	CacheTTL time.Duration
+
+	cacheMu sync.Mutex
+	cache   map[string]policyCacheEntry
 }
 
 type NoOpPolicyChecker struct {
@@ -29,13 +63,19 @@ func (p NoOpPolicyChecker) Check(_ string, _ string, _ string, _ string, _ strin
 	return true, nil
 }
 
-func (p *DiggerHttpPolicyProvider) getPolicyForOrganisation() (string, *http.Response, error) {
-	organisation := p.DiggerOrganisation
-	req, err := http.NewRequest("GET", p.DiggerHost+"/orgs/"+organisation+"/access-policy", nil)
+// authorizedGet performs a single GET against url with a fresh bearer token
+// from p.TokenSource.
+func (p *DiggerHttpPolicyProvider) authorizedGet(url string) (string, *http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := p.TokenSource.Token()
 	if err != nil {
 		return "", nil, err
 	}
-	req.Header.Add("Authorization", "Bearer "+p.AuthToken)
+	req.Header.Add("Authorization", "Bearer "+token)
 
 	resp, err := p.HttpClient.Do(req)
 	if err != nil {
@@ -50,94 +90,231 @@ func (p *DiggerHttpPolicyProvider) getPolicyForOrganisation() (string, *http.Res
 	return string(body), resp, nil
 }
 
-func (p *DiggerHttpPolicyProvider) getPolicyForNamespace(namespace string, projectName string) (string, *http.Response, error) {
+// doAuthorizedGet wraps authorizedGet with 401/403 classification: a 401
+// (ErrTokenExpired) forces the token source to refresh (it may still think
+// the token it handed out is valid) and is retried once, a 403
+// (ErrTokenRevoked) is returned as-is since retrying won't help.
+func (p *DiggerHttpPolicyProvider) doAuthorizedGet(url string) (string, *http.Response, error) {
+	body, resp, err := p.authorizedGet(url)
+	if err != nil {
+		return "", resp, err
+	}
 
-	// fetch RBAC policies for projectfrom Digger API
-	namespace = strings.ReplaceAll(namespace, "/", "-")
-	req, err := http.NewRequest("GET", p.DiggerHost+"/repos/"+namespace+"/projects/"+projectName+"/access-policy", nil)
+	classified := auth.ClassifyHTTPError(resp.StatusCode)
+	if classified == nil {
+		return body, resp, nil
+	}
+	if classified != auth.ErrTokenExpired {
+		return "", resp, classified
+	}
 
+	p.TokenSource.Invalidate()
+	body, resp, err = p.authorizedGet(url)
 	if err != nil {
-		return "", nil, err
+		return "", resp, err
+	}
+	if classified := auth.ClassifyHTTPError(resp.StatusCode); classified != nil {
+		return "", resp, classified
 	}
-	req.Header.Add("Authorization", "Bearer "+p.AuthToken)
+	return body, resp, nil
+}
 
-	resp, err := p.HttpClient.Do(req)
-	if err != nil {
-		return "", nil, err
+func (p *DiggerHttpPolicyProvider) getPolicyForOrganisation() (string, *http.Response, error) {
+	organisation := p.DiggerOrganisation
+	url := p.DiggerHost + "/orgs/" + organisation + "/access-policy"
+	if p.Merge {
+		url += "?merge=true"
 	}
-	defer resp.Body.Close()
+	return p.doAuthorizedGet(url)
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", resp, nil
+func (p *DiggerHttpPolicyProvider) getPolicyForNamespace(namespace string, projectName string) (string, *http.Response, error) {
+	// fetch RBAC policies for projectfrom Digger API
+	namespace = strings.ReplaceAll(namespace, "/", "-")
+	url := p.DiggerHost + "/repos/" + namespace + "/projects/" + projectName + "/access-policy"
+	if p.Merge {
+		url += "?merge=true"
 	}
-	return string(body), resp, nil
+	return p.doAuthorizedGet(url)
+}
 
+// namespaceLevels returns namespace's group path from deepest to shallowest,
+// e.g. "group/subgroup" -> []string{"group/subgroup", "group"}.
+func namespaceLevels(namespace string) []string {
+	parts := strings.Split(namespace, "/")
+	levels := make([]string, 0, len(parts))
+	for i := len(parts); i > 0; i-- {
+		levels = append(levels, strings.Join(parts[:i], "/"))
+	}
+	return levels
 }
 
-// GetPolicy fetches policy for particular project,  if not found then it will fallback to org level policy
+// GetPolicy fetches the policy for a project, cascading up GitLab's nested
+// groups (group/subgroup/.../project -> group/subgroup -> group) and
+// finally the organisation, making one request per level. With Merge
+// disabled (the default) it short-circuits on the first 200, so the
+// deepest group that has a policy wins; with Merge enabled it concatenates
+// every level's policy, letting a subgroup's rules add to its parent's.
+// Results (including "nothing found anywhere") are cached for CacheTTL so a
+// burst of Check calls doesn't repeat the whole walk.
 func (p *DiggerHttpPolicyProvider) GetPolicy(namespace string, projectName string) (string, error) {
-	content, resp, err := p.getPolicyForNamespace(namespace, projectName)
-	if err != nil {
-		return "", err
+	if policy, ok := p.cacheGet(namespace, projectName); ok {
+		return policy, nil
 	}
-	if resp.StatusCode == 200 {
-		return content, nil
-	} else if resp.StatusCode == 404 {
-		content, resp, err := p.getPolicyForOrganisation()
+
+	var policies []string
+	for _, level := range namespaceLevels(namespace) {
+		content, resp, err := p.getPolicyForNamespace(level, projectName)
 		if err != nil {
 			return "", err
 		}
 		if resp.StatusCode == 200 {
-			return content, nil
-		} else if resp.StatusCode == 404 {
-			return "", nil
-		} else {
-			return "", errors.New(fmt.Sprintf("unexpected response while fetching organisation policy: %v, code %v", content, resp.StatusCode))
+			if !p.Merge {
+				p.cacheSet(namespace, projectName, content)
+				return content, nil
+			}
+			policies = append(policies, content)
+		} else if resp.StatusCode != 404 {
+			return "", errors.New(fmt.Sprintf("unexpected response while fetching policy for %v: %v code %v", level, content, resp.StatusCode))
 		}
-	} else {
-		return "", errors.New(fmt.Sprintf("unexpected response while fetching org policy: %v code %v", content, resp.StatusCode))
 	}
+
+	content, resp, err := p.getPolicyForOrganisation()
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == 200 {
+		policies = append(policies, content)
+	} else if resp.StatusCode != 404 {
+		return "", errors.New(fmt.Sprintf("unexpected response while fetching organisation policy: %v, code %v", content, resp.StatusCode))
+	}
+
+	policy := mergePolicies(policies)
+	p.cacheSet(namespace, projectName, policy)
+	return policy, nil
 }
 
-type DiggerPolicyChecker struct {
-	PolicyProvider DiggerHttpPolicyProvider
-	ciService      ci.CIService
+// mergedPolicySeparator joins the individually-fetched policy modules for a
+// Merge lookup into the single string GetPolicy returns. It can't be a bare
+// "\n": each module is a full Rego module with its own "package digger"
+// header, so naively concatenating the source text would produce one module
+// with duplicate package declarations, which Rego rejects. evalRego splits
+// on this separator and registers each half as its own named rego.Module
+// instead, which is how Rego expects multiple modules of the same package
+// to be combined.
+const mergedPolicySeparator = "\n#!digger-merge-boundary\n"
+
+// mergePolicies combines the Rego modules fetched for each namespace level
+// (deepest first) plus the organisation into the single policy string
+// GetPolicy returns, for evalRego to later split back apart.
+func mergePolicies(policies []string) string {
+	return strings.Join(policies, mergedPolicySeparator)
 }
 
-func (p DiggerPolicyChecker) Check(githubOrganisation string, namespace string, projectName string, command string, requestedBy string) (bool, error) {
-	organisation := p.PolicyProvider.DiggerOrganisation
-	policy, err := p.PolicyProvider.GetPolicy(namespace, projectName)
-	teams, err := p.ciService.GetUserTeams(githubOrganisation, requestedBy)
-	if err != nil {
-		fmt.Printf("Error while fetching user teams for CI service: %v", err)
-		return false, err
+// Refresh drops any cached result for (namespace, projectName).
+func (p *DiggerHttpPolicyProvider) Refresh(namespace string, projectName string) {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	delete(p.cache, namespace+"|"+projectName)
+}
+
+func (p *DiggerHttpPolicyProvider) cacheGet(namespace string, projectName string) (string, bool) {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+
+	entry, ok := p.cache[namespace+"|"+projectName]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return "", false
 	}
+	return entry.policy, true
+}
+
+func (p *DiggerHttpPolicyProvider) cacheSet(namespace string, projectName string, policy string) {
+	ttl := p.CacheTTL
+	if ttl == 0 {
+		ttl = defaultPolicyCacheTTL
+	}
+
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
 
-	input := map[string]interface{}{
+	if p.cache == nil {
+		p.cache = make(map[string]policyCacheEntry)
+	}
+	p.cache[namespace+"|"+projectName] = policyCacheEntry{policy: policy, expiresAt: time.Now().Add(ttl)}
+}
+
+// policyInput builds the program environment shared by every policy engine.
+func policyInput(organisation string, teams []string, command string, projectName string, requestedBy string) map[string]interface{} {
+	return map[string]interface{}{
 		"user":         requestedBy,
 		"organisation": organisation,
 		"teams":        teams,
 		"action":       command,
 		"project":      projectName,
 	}
+}
+
+// fetchCheckInput fetches the policy for namespace/projectName and builds
+// the program input (user, organisation, teams, action, project) shared by
+// every Checker implementation's Check method, so none of them have to
+// duplicate the fetch-policy/fetch-teams/build-input preamble.
+func fetchCheckInput(provider *DiggerHttpPolicyProvider, ciService ci.CIService, githubOrganisation string, namespace string, projectName string, command string, requestedBy string) (string, map[string]interface{}, error) {
+	policy, err := provider.GetPolicy(namespace, projectName)
+	if err != nil {
+		return "", nil, err
+	}
+	teams, err := ciService.GetUserTeams(githubOrganisation, requestedBy)
+	if err != nil {
+		fmt.Printf("Error while fetching user teams for CI service: %v", err)
+		return "", nil, err
+	}
+
+	input := policyInput(provider.DiggerOrganisation, teams, command, projectName, requestedBy)
+	return policy, input, nil
+}
+
+type DiggerPolicyChecker struct {
+	PolicyProvider *DiggerHttpPolicyProvider
+	ciService      ci.CIService
+}
 
+func (p DiggerPolicyChecker) Check(githubOrganisation string, namespace string, projectName string, command string, requestedBy string) (bool, error) {
+	policy, input, err := fetchCheckInput(p.PolicyProvider, p.ciService, githubOrganisation, namespace, projectName, command, requestedBy)
+	if err != nil {
+		return false, err
+	}
+	return evalRego(policy, input)
+}
+
+func evalRego(policy string, input map[string]interface{}) (bool, error) {
 	if policy == "" {
 		return true, nil
 	}
 
 	ctx := context.Background()
 	fmt.Printf("DEBUG: passing the following input policy: %v ||| text: %v", input, policy)
-	query, err := rego.New(
-		rego.Query("data.digger.allow"),
-		rego.Module("digger", policy),
-	).PrepareForEval(ctx)
+
+	// A Merge'd policy is multiple distinct Rego modules (one per namespace
+	// level) joined by mergedPolicySeparator; each needs its own rego.Module
+	// name so OPA combines their "allow" rules instead of choking on
+	// duplicate package declarations in one module.
+	modules := strings.Split(policy, mergedPolicySeparator)
+	options := make([]func(*rego.Rego), 0, len(modules)+1)
+	options = append(options, rego.Query("data.digger.allow"))
+	for i, module := range modules {
+		options = append(options, rego.Module(fmt.Sprintf("digger%d", i), module))
+	}
+	query, err := rego.New(options...).PrepareForEval(ctx)
 
 	if err != nil {
 		return false, err
 	}
 
 	results, err := query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return false, err
+	}
 	if len(results) == 0 || len(results[0].Expressions) == 0 {
 		return false, fmt.Errorf("no result found")
 	}
@@ -156,3 +333,122 @@ func (p DiggerPolicyChecker) Check(githubOrganisation string, namespace string,
 
 	return true, nil
 }
+
+// ExprPolicyChecker is a lighter-weight alternative to DiggerPolicyChecker for
+// teams that would rather write a single boolean expression (using
+// antonmedv/expr) than a Rego module, e.g.:
+//
+//	"infra" in teams && action in ["digger plan"] || organisation == "acme"
+type ExprPolicyChecker struct {
+	PolicyProvider *DiggerHttpPolicyProvider
+	ciService      ci.CIService
+
+	programCacheMu sync.Mutex
+	programCache   map[string]*vm.Program
+}
+
+func (p *ExprPolicyChecker) Check(githubOrganisation string, namespace string, projectName string, command string, requestedBy string) (bool, error) {
+	policy, input, err := fetchCheckInput(p.PolicyProvider, p.ciService, githubOrganisation, namespace, projectName, command, requestedBy)
+	if err != nil {
+		return false, err
+	}
+	return p.checkPolicy(namespace, projectName, policy, input)
+}
+
+// checkPolicy compiles (or reuses a cached compile of) policy and evaluates
+// it against input. It's split out from Check so MultiEngineChecker, which
+// fetches the policy itself to inspect its engine marker, can still run the
+// expr engine through the exact same path rather than re-deriving it.
+func (p *ExprPolicyChecker) checkPolicy(namespace string, projectName string, policy string, input map[string]interface{}) (bool, error) {
+	program, err := p.compile(namespace, projectName, policy)
+	if err != nil {
+		return false, err
+	}
+	return evalExprProgram(program, input)
+}
+
+// compile returns a cached *vm.Program for the given namespace/project/policy
+// combination, compiling and caching it on first use so repeated Check calls
+// don't re-parse the same policy.
+func (p *ExprPolicyChecker) compile(namespace string, projectName string, policy string) (*vm.Program, error) {
+	if policy == "" {
+		return nil, nil
+	}
+
+	policyHash := sha256.Sum256([]byte(policy))
+	cacheKey := namespace + "|" + projectName + "|" + hex.EncodeToString(policyHash[:])
+
+	p.programCacheMu.Lock()
+	defer p.programCacheMu.Unlock()
+
+	if p.programCache == nil {
+		p.programCache = make(map[string]*vm.Program)
+	}
+	if program, ok := p.programCache[cacheKey]; ok {
+		return program, nil
+	}
+
+	program, err := expr.Compile(policy, expr.Env(policyInput("", nil, "", "", "")), expr.AllowUndefinedVariables(), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("could not compile expr policy: %v", err)
+	}
+
+	p.programCache[cacheKey] = program
+	return program, nil
+}
+
+func evalExprProgram(program *vm.Program, input map[string]interface{}) (bool, error) {
+	if program == nil {
+		return true, nil
+	}
+
+	output, err := expr.Run(program, input)
+	if err != nil {
+		return false, fmt.Errorf("could not evaluate expr policy: %v", err)
+	}
+
+	decision, ok := output.(bool)
+	if !ok {
+		return false, fmt.Errorf("decision is not a boolean")
+	}
+	return decision, nil
+}
+
+const (
+	exprEngineMarker = "#!expr"
+	regoEngineMarker = "#!rego"
+)
+
+// MultiEngineChecker picks between DiggerPolicyChecker (Rego) and
+// ExprPolicyChecker (expr) based on a leading shebang-like marker in the
+// policy text (#!expr / #!rego), defaulting to Rego for backwards
+// compatibility with policies that don't carry a marker. Existing callers
+// that construct a Checker don't need to change.
+type MultiEngineChecker struct {
+	PolicyProvider *DiggerHttpPolicyProvider
+	ciService      ci.CIService
+
+	exprCheckerOnce sync.Once
+	exprChecker     *ExprPolicyChecker
+}
+
+func (p *MultiEngineChecker) Check(githubOrganisation string, namespace string, projectName string, command string, requestedBy string) (bool, error) {
+	policy, input, err := fetchCheckInput(p.PolicyProvider, p.ciService, githubOrganisation, namespace, projectName, command, requestedBy)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case strings.HasPrefix(strings.TrimSpace(policy), exprEngineMarker):
+		policy = strings.TrimPrefix(strings.TrimSpace(policy), exprEngineMarker)
+		p.exprCheckerOnce.Do(func() {
+			p.exprChecker = &ExprPolicyChecker{PolicyProvider: p.PolicyProvider, ciService: p.ciService}
+		})
+		return p.exprChecker.checkPolicy(namespace, projectName, policy, input)
+	case strings.HasPrefix(strings.TrimSpace(policy), regoEngineMarker):
+		policy = strings.TrimPrefix(strings.TrimSpace(policy), regoEngineMarker)
+		return evalRego(policy, input)
+	default:
+		return evalRego(policy, input)
+	}
+}
@@ -0,0 +1,95 @@
+package policy
+
+import (
+	"digger/pkg/auth"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNamespaceLevels(t *testing.T) {
+	tests := []struct {
+		namespace string
+		want      []string
+	}{
+		{"group/subgroup/project-namespace", []string{"group/subgroup/project-namespace", "group/subgroup", "group"}},
+		{"group", []string{"group"}},
+	}
+
+	for _, tt := range tests {
+		if got := namespaceLevels(tt.namespace); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("namespaceLevels(%q) = %v, want %v", tt.namespace, got, tt.want)
+		}
+	}
+}
+
+func TestEvalRego_MergedPolicyCompilesAsSeparateModules(t *testing.T) {
+	// Two independent Rego modules, each declaring "package digger", joined
+	// the way GetPolicy's Merge path joins them. Concatenating their raw
+	// source text would fail to compile (duplicate "package digger"); this
+	// only compiles because evalRego registers each half as its own named
+	// rego.Module.
+	subgroupPolicy := `package digger
+
+allow { input.user == "alice" }`
+	orgPolicy := `package digger
+
+allow { input.action == "digger plan" }`
+
+	merged := mergePolicies([]string{subgroupPolicy, orgPolicy})
+
+	allowed, err := evalRego(merged, map[string]interface{}{
+		"user":   "alice",
+		"action": "digger plan",
+	})
+	if err != nil {
+		t.Fatalf("evalRego returned error for a merged policy: %v", err)
+	}
+	if !allowed {
+		t.Fatalf("evalRego(merged) = false, want true")
+	}
+}
+
+func TestGetPolicy_MergeConcatenatesEveryLevelAsASeparateModule(t *testing.T) {
+	subgroupPolicy := `package digger
+
+allow { input.user == "alice" }`
+	orgPolicy := `package digger
+
+allow { input.action == "digger plan" }`
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/group/projects/myproject/access-policy", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(subgroupPolicy))
+	})
+	mux.HandleFunc("/orgs/acme/access-policy", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(orgPolicy))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	provider := &DiggerHttpPolicyProvider{
+		DiggerHost:         server.URL,
+		DiggerOrganisation: "acme",
+		TokenSource:        auth.NewStaticTokenSource("test-token"),
+		HttpClient:         server.Client(),
+		Merge:              true,
+	}
+
+	policy, err := provider.GetPolicy("group", "myproject")
+	if err != nil {
+		t.Fatalf("GetPolicy returned error: %v", err)
+	}
+
+	allowed, err := evalRego(policy, map[string]interface{}{
+		"user":   "alice",
+		"action": "digger plan",
+	})
+	if err != nil {
+		t.Fatalf("evalRego(GetPolicy result) returned error: %v", err)
+	}
+	if !allowed {
+		t.Fatalf("evalRego(GetPolicy result) = false, want true")
+	}
+}